@@ -0,0 +1,170 @@
+package boltstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func Test_GobCodec(t *testing.T) {
+	r := stubRecord("A", "1", time.Now())
+
+	b, err := GobCodec{}.Marshal(r)
+	require.NoError(t, err)
+	assert.NotEmpty(t, b)
+
+	var got record
+	require.NoError(t, GobCodec{}.Unmarshal(b, &got))
+	equalSession(t, r.extractSession(), got.extractSession())
+}
+
+func Test_JSONCodec(t *testing.T) {
+	r := stubRecord("A", "1", time.Now())
+
+	b, err := JSONCodec{}.Marshal(r)
+	require.NoError(t, err)
+	assert.NotEmpty(t, b)
+
+	var got record
+	require.NoError(t, JSONCodec{}.Unmarshal(b, &got))
+	equalSession(t, r.extractSession(), got.extractSession())
+}
+
+func (s *Suite) Test_BoltStore_Migrate() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "migrate.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	st, err := New(db, "b", 0)
+	s.Require().NoError(err)
+
+	sess1 := stubSession("A", "1", time.Now().Add(time.Hour))
+	sess2 := stubSession("B", "2", time.Now().Add(time.Hour))
+
+	s.Require().NoError(st.Create(context.Background(), sess1))
+	s.Require().NoError(st.Create(context.Background(), sess2))
+
+	s.Require().NoError(st.Migrate(GobCodec{}, JSONCodec{}))
+
+	st2, err := New(db, "b", 0, WithCodec(JSONCodec{}))
+	s.Require().NoError(err)
+
+	got1, ok, err := st2.FetchByID(context.Background(), "1")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), sess1, got1)
+
+	got2, ok, err := st2.FetchByID(context.Background(), "2")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), sess2, got2)
+}
+
+func Benchmark_GobCodec_Marshal(b *testing.B) {
+	r := stubRecord("A", "1", time.Now())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := (GobCodec{}).Marshal(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_JSONCodec_Marshal(b *testing.B) {
+	r := stubRecord("A", "1", time.Now())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := (JSONCodec{}).Marshal(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_GobCodec_Unmarshal(b *testing.B) {
+	r := stubRecord("A", "1", time.Now())
+
+	enc, err := (GobCodec{}).Marshal(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var got record
+		if err := (GobCodec{}).Unmarshal(enc, &got); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_JSONCodec_Unmarshal(b *testing.B) {
+	r := stubRecord("A", "1", time.Now())
+
+	enc, err := (JSONCodec{}).Marshal(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var got record
+		if err := (JSONCodec{}).Unmarshal(enc, &got); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// bucketSize populates a fresh store of n sessions under codec and returns
+// the resulting bolt file size, so Gob's and JSON's on-disk footprint can be
+// compared directly rather than inferred from their encode/decode costs.
+func bucketSize(b *testing.B, codec Codec, n int) int64 {
+	b.Helper()
+
+	path := filepath.Join(b.TempDir(), "size.db")
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	st, err := New(db, "b", 0, WithCodec(codec))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		uk := strconv.Itoa(i % 1000)
+		sess := stubSession(uk, strconv.Itoa(i), time.Now().Add(time.Hour))
+		if err := st.Create(context.Background(), sess); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return info.Size()
+}
+
+// bucketSizeSessionCount matches the "100k sessions" figure used to size
+// the bucket-size comparison benchmarks below.
+const bucketSizeSessionCount = 100000
+
+func Benchmark_GobCodec_BucketSize(b *testing.B) {
+	b.ReportMetric(float64(bucketSize(b, GobCodec{}, bucketSizeSessionCount)), "file-bytes")
+}
+
+func Benchmark_JSONCodec_BucketSize(b *testing.B) {
+	b.ReportMetric(float64(bucketSize(b, JSONCodec{}, bucketSizeSessionCount)), "file-bytes")
+}
@@ -0,0 +1,233 @@
+package boltstore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"runtime"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxEncryptionKeys is the number of keys that can be held in a key ring,
+// bounded by the single byte used to tag each record with its key ID.
+const maxEncryptionKeys = 256
+
+// encryptedCodec wraps a Codec with AES-GCM encryption. Every ciphertext
+// is prefixed with a 1-byte key ID, identifying which entry of gcms
+// encrypted it, followed by the GCM nonce.
+type encryptedCodec struct {
+	codec Codec
+	gcms  []cipher.AEAD
+}
+
+// newEncryptedCodec builds an encryptedCodec wrapping codec, using keys[0]
+// as the active encryption key and the rest as decrypt-only keys accepted
+// during rotation.
+func newEncryptedCodec(codec Codec, keys [][]byte) (*encryptedCodec, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoEncryptionKeys
+	}
+
+	if len(keys) > maxEncryptionKeys {
+		return nil, ErrTooManyEncryptionKeys
+	}
+
+	gcms := make([]cipher.AEAD, len(keys))
+
+	for i, k := range keys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		gcms[i] = gcm
+	}
+
+	return &encryptedCodec{codec: codec, gcms: gcms}, nil
+}
+
+// Marshal encodes r with the wrapped codec and encrypts the result with
+// the active (first) key.
+func (c *encryptedCodec) Marshal(r record) ([]byte, error) {
+	plain, err := c.codec.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.seal(0, plain)
+}
+
+// Unmarshal decrypts b, trying the key referenced by its key ID prefix
+// first and then every other configured key (see open), and decodes the
+// result with the wrapped codec.
+func (c *encryptedCodec) Unmarshal(b []byte, r *record) error {
+	plain, _, err := c.open(b)
+	if err != nil {
+		return err
+	}
+
+	return c.codec.Unmarshal(plain, r)
+}
+
+// seal encrypts plain with gcms[keyID], returning keyID || nonce || ciphertext.
+func (c *encryptedCodec) seal(keyID int, plain []byte) ([]byte, error) {
+	gcm := c.gcms[keyID]
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 1+len(nonce)+gcm.Overhead()+len(plain))
+	out = append(out, byte(keyID))
+	out = append(out, nonce...)
+	out = gcm.Seal(out, nonce, plain, nil)
+
+	return out, nil
+}
+
+// open parses b's key ID and nonce prefix and decrypts the remainder,
+// returning the plaintext along with the key ID that actually decrypted it.
+//
+// The leading key ID is only a hint: it records the ring position a record
+// was encrypted under at the time, which a later rotation can shift out from
+// under it (e.g. a new active key gets prepended). open tries the hinted
+// key first, since it's almost always right, then falls back to every other
+// configured key before giving up, so records survive key ring reordering
+// as long as the key that encrypted them is still present somewhere in it.
+func (c *encryptedCodec) open(b []byte) ([]byte, int, error) {
+	nonceSize := c.gcms[0].NonceSize()
+	if len(b) < 1+nonceSize {
+		return nil, 0, ErrCiphertextTooShort
+	}
+
+	hint := int(b[0])
+	nonce := b[1 : 1+nonceSize]
+	ciphertext := b[1+nonceSize:]
+
+	order := make([]int, 0, len(c.gcms))
+	if hint >= 0 && hint < len(c.gcms) {
+		order = append(order, hint)
+	}
+	for i := range c.gcms {
+		if i != hint {
+			order = append(order, i)
+		}
+	}
+
+	var lastErr error
+	for _, keyID := range order {
+		plain, err := c.gcms[keyID].Open(nil, nonce, ciphertext, nil)
+		if err == nil {
+			return plain, keyID, nil
+		}
+
+		lastErr = err
+	}
+
+	if hint < 0 || hint >= len(c.gcms) {
+		return nil, 0, ErrUnknownEncryptionKey
+	}
+
+	return nil, 0, lastErr
+}
+
+// Rotate re-encrypts every record still using a non-active encryption key
+// with the current active key, in batches of cleanupBatchSize so that a
+// single long write transaction doesn't block concurrent Store calls. It
+// is safe to call again after being interrupted (e.g. by a crash): records
+// already on the active key are left untouched.
+func (b *BoltStore) Rotate(ctx context.Context) error {
+	ec, ok := b.codec.(*encryptedCodec)
+	if !ok {
+		return ErrEncryptionNotConfigured
+	}
+
+	batchSize := b.cleanupBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultCleanupBatchSize
+	}
+
+	type rewrite struct {
+		key []byte
+		val []byte
+	}
+
+	offset := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var (
+			rr    []rewrite
+			found int
+		)
+
+		err := b.detectErr(b.db.Select().Skip(offset).Limit(batchSize).Bucket(recordBucket).RawEach(
+			func(k, v []byte) error {
+				found++
+
+				plain, keyID, err := ec.open(v)
+				if err != nil {
+					return err
+				}
+
+				if keyID == 0 {
+					return nil
+				}
+
+				val, err := ec.seal(0, plain)
+				if err != nil {
+					return err
+				}
+
+				rr = append(rr, rewrite{key: append([]byte(nil), k...), val: val})
+
+				return nil
+			},
+		))
+		if err != nil {
+			return err
+		}
+
+		if found == 0 {
+			return nil
+		}
+
+		offset += found
+
+		if len(rr) > 0 {
+			err := b.boltDB.Update(func(tx *bolt.Tx) error {
+				bucket := b.db.GetBucket(tx, recordBucket)
+				if bucket == nil {
+					return nil
+				}
+
+				for _, r := range rr {
+					if err := bucket.Put(r.key, r.val); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		runtime.Gosched()
+	}
+}
@@ -0,0 +1,283 @@
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func key(b byte) []byte {
+	k := make([]byte, 32)
+	for i := range k {
+		k[i] = b
+	}
+
+	return k
+}
+
+func Test_newEncryptedCodec(t *testing.T) {
+	// no keys
+	ec, err := newEncryptedCodec(GobCodec{}, nil)
+	require.Equal(t, ErrNoEncryptionKeys, err)
+	assert.Nil(t, ec)
+
+	// too many keys
+	keys := make([][]byte, maxEncryptionKeys+1)
+	for i := range keys {
+		keys[i] = key(1)
+	}
+
+	ec, err = newEncryptedCodec(GobCodec{}, keys)
+	require.Equal(t, ErrTooManyEncryptionKeys, err)
+	assert.Nil(t, ec)
+
+	// invalid key size
+	ec, err = newEncryptedCodec(GobCodec{}, [][]byte{{1, 2, 3}})
+	require.Error(t, err)
+	assert.Nil(t, ec)
+
+	// success
+	ec, err = newEncryptedCodec(GobCodec{}, [][]byte{key(1)})
+	require.NoError(t, err)
+	assert.NotNil(t, ec)
+}
+
+func Test_encryptedCodec_roundtrip(t *testing.T) {
+	r := stubRecord("A", "1", time.Now())
+
+	ec, err := newEncryptedCodec(GobCodec{}, [][]byte{key(1)})
+	require.NoError(t, err)
+
+	enc, err := ec.Marshal(r)
+	require.NoError(t, err)
+	assert.NotEmpty(t, enc)
+
+	var got record
+	require.NoError(t, ec.Unmarshal(enc, &got))
+	equalSession(t, r.extractSession(), got.extractSession())
+}
+
+func Test_encryptedCodec_Unmarshal_truncated(t *testing.T) {
+	ec, err := newEncryptedCodec(GobCodec{}, [][]byte{key(1)})
+	require.NoError(t, err)
+
+	var got record
+
+	assert.Equal(t, ErrCiphertextTooShort, ec.Unmarshal(nil, &got))
+	assert.Equal(t, ErrCiphertextTooShort, ec.Unmarshal([]byte{0}, &got))
+}
+
+func Test_encryptedCodec_Unmarshal_unknownKey(t *testing.T) {
+	ec, err := newEncryptedCodec(GobCodec{}, [][]byte{key(1)})
+	require.NoError(t, err)
+
+	var got record
+
+	garbage := append([]byte{7}, make([]byte, 20)...)
+	assert.Equal(t, ErrUnknownEncryptionKey, ec.Unmarshal(garbage, &got))
+}
+
+func Test_encryptedCodec_Unmarshal_keyMismatch(t *testing.T) {
+	a, err := newEncryptedCodec(GobCodec{}, [][]byte{key(1)})
+	require.NoError(t, err)
+
+	bWrong, err := newEncryptedCodec(GobCodec{}, [][]byte{key(2)})
+	require.NoError(t, err)
+
+	enc, err := a.Marshal(stubRecord("A", "1", time.Now()))
+	require.NoError(t, err)
+
+	var got record
+	err = bWrong.Unmarshal(enc, &got)
+	assert.Error(t, err)
+}
+
+func Test_encryptedCodec_rotation_key_ring(t *testing.T) {
+	// record encrypted with what used to be the active key (index 0)...
+	old, err := newEncryptedCodec(GobCodec{}, [][]byte{key(1)})
+	require.NoError(t, err)
+
+	r := stubRecord("A", "1", time.Now())
+	enc, err := old.Marshal(r)
+	require.NoError(t, err)
+
+	// ... is still readable once that key becomes the second entry of a
+	// new key ring, with a different active key in front of it.
+	rotated, err := newEncryptedCodec(GobCodec{}, [][]byte{key(2), key(1)})
+	require.NoError(t, err)
+
+	var got record
+	require.NoError(t, rotated.Unmarshal(enc, &got))
+	equalSession(t, r.extractSession(), got.extractSession())
+
+	plain, keyID, err := rotated.open(enc)
+	require.NoError(t, err)
+	assert.Equal(t, 1, keyID)
+	assert.NotEmpty(t, plain)
+}
+
+func (s *Suite) Test_BoltStore_Rotate_notConfigured() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "rotate-none.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	st, err := New(db, "b", 0)
+	s.Require().NoError(err)
+
+	s.Assert().Equal(ErrEncryptionNotConfigured, st.Rotate(context.Background()))
+}
+
+func (s *Suite) Test_BoltStore_Rotate() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "rotate.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	stOld, err := New(db, "b", 0, WithEncryption(key(1)))
+	s.Require().NoError(err)
+
+	sess1 := stubSession("A", "1", time.Now().Add(time.Hour))
+	sess2 := stubSession("B", "2", time.Now().Add(time.Hour))
+	s.Require().NoError(stOld.Create(context.Background(), sess1))
+	s.Require().NoError(stOld.Create(context.Background(), sess2))
+
+	// key(2) becomes active, key(1) is kept around to decrypt existing records.
+	stRotating, err := New(db, "b", 0, WithEncryption(key(2), key(1)))
+	s.Require().NoError(err)
+
+	got, ok, err := stRotating.FetchByID(context.Background(), "1")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), sess1, got)
+
+	s.Require().NoError(stRotating.Rotate(context.Background()))
+
+	// re-running rotation afterwards is a safe no-op.
+	s.Require().NoError(stRotating.Rotate(context.Background()))
+
+	// a store that only knows the new active key can now read every record.
+	stNew, err := New(db, "b", 0, WithEncryption(key(2)))
+	s.Require().NoError(err)
+
+	got, ok, err = stNew.FetchByID(context.Background(), "1")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), sess1, got)
+
+	got, ok, err = stNew.FetchByID(context.Background(), "2")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), sess2, got)
+
+	// the old key alone can no longer decrypt the rotated records.
+	stOldOnly, err := New(db, "b", 0, WithEncryption(key(1)))
+	s.Require().NoError(err)
+
+	_, _, err = stOldOnly.FetchByID(context.Background(), "1")
+	s.Assert().Error(err)
+}
+
+// cancelAfterCtx cancels itself only once its Done channel has been polled
+// n times, so a caller that checks ctx.Done() once per batch can interrupt
+// work after a chosen number of batches have already committed, rather than
+// only before the very first one.
+type cancelAfterCtx struct {
+	context.Context
+	remaining int
+	ch        chan struct{}
+	triggered bool
+}
+
+func newCancelAfterCtx(n int) *cancelAfterCtx {
+	return &cancelAfterCtx{Context: context.Background(), remaining: n, ch: make(chan struct{})}
+}
+
+func (c *cancelAfterCtx) Done() <-chan struct{} {
+	if c.remaining > 0 {
+		c.remaining--
+		return nil
+	}
+
+	if !c.triggered {
+		c.triggered = true
+		close(c.ch)
+	}
+
+	return c.ch
+}
+
+func (c *cancelAfterCtx) Err() error {
+	if c.triggered {
+		return context.Canceled
+	}
+
+	return nil
+}
+
+func (s *Suite) Test_BoltStore_Rotate_resumesAfterInterruption() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "rotate-resume.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	stOld, err := New(db, "b", 0, WithEncryption(key(1)))
+	s.Require().NoError(err)
+
+	for i := 0; i < 3; i++ {
+		sess := stubSession("A", string(rune('1'+i)), time.Now().Add(time.Hour))
+		s.Require().NoError(stOld.Create(context.Background(), sess))
+	}
+
+	// one record per batch, so the interrupt below lands after exactly one
+	// record has been rewritten onto the new key.
+	stRotating, err := New(db, "b", 0, WithEncryption(key(2), key(1)), WithCleanupBatchSize(1))
+	s.Require().NoError(err)
+
+	// interrupts rotation only after its first batch has already been
+	// committed, leaving a genuinely mixed store: one record re-encrypted
+	// with the new key, two still on the old one.
+	s.Assert().Equal(context.Canceled, stRotating.Rotate(newCancelAfterCtx(1)))
+
+	stOldOnly, err := New(db, "b", 0, WithEncryption(key(1)))
+	s.Require().NoError(err)
+
+	stNewOnly, err := New(db, "b", 0, WithEncryption(key(2)))
+	s.Require().NoError(err)
+
+	var onNew, onOld int
+	for i := 0; i < 3; i++ {
+		id := string(rune('1' + i))
+
+		if _, ok, err := stNewOnly.FetchByID(context.Background(), id); err == nil && ok {
+			onNew++
+			continue
+		}
+
+		_, ok, err := stOldOnly.FetchByID(context.Background(), id)
+		s.Require().NoError(err)
+		s.Require().True(ok)
+		onOld++
+	}
+
+	s.Assert().Equal(1, onNew)
+	s.Assert().Equal(2, onOld)
+
+	// a follow-up call with a live context finishes the job.
+	s.Require().NoError(stRotating.Rotate(context.Background()))
+
+	for i := 0; i < 3; i++ {
+		_, ok, err := stNewOnly.FetchByID(context.Background(), string(rune('1'+i)))
+		s.Require().NoError(err)
+		s.Require().True(ok)
+	}
+}
+
+func Test_encryptedCodec_seal_prefixesKeyID(t *testing.T) {
+	ec, err := newEncryptedCodec(GobCodec{}, [][]byte{key(1), key(2)})
+	require.NoError(t, err)
+
+	enc, err := ec.seal(1, []byte("payload"))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(enc, []byte{1}))
+}
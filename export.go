@@ -0,0 +1,242 @@
+package boltstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jellydator/sessionup"
+	bolt "go.etcd.io/bbolt"
+)
+
+// exportSchemaVersion identifies the wire format Export writes and Import
+// reads. It must be bumped whenever that format changes incompatibly.
+const exportSchemaVersion uint32 = 1
+
+var (
+	// ErrUnsupportedSchemaVersion is returned by Import when the stream
+	// was written by a schema version this build doesn't understand.
+	ErrUnsupportedSchemaVersion = errors.New("unsupported export schema version")
+
+	// ErrCorruptExport is returned by Import when the stream ends, or a
+	// record's declared length doesn't match the bytes available, partway
+	// through reading it.
+	ErrCorruptExport = errors.New("corrupt export stream")
+)
+
+// ImportMode controls how Import reconciles an incoming record with one
+// already stored under the same ID.
+type ImportMode int
+
+const (
+	// ImportMerge keeps the existing record and skips the incoming one
+	// whenever their IDs collide.
+	ImportMerge ImportMode = iota
+
+	// ImportReplace overwrites the existing record with the incoming one
+	// whenever their IDs collide.
+	ImportReplace
+
+	// ImportReset drops every record already in the bucket before
+	// importing.
+	ImportReset
+)
+
+// Export streams every session currently in the store to w: a header
+// carrying the schema version, bucket name and record count, followed by
+// each record length-prefixed and encoded with the store's configured
+// codec.
+func (b *BoltStore) Export(_ context.Context, w io.Writer) error {
+	var rr []record
+	if err := b.detectErr(b.db.All(&rr)); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	if err := binary.Write(bw, binary.BigEndian, exportSchemaVersion); err != nil {
+		return err
+	}
+
+	if err := writeString(bw, strings.Join(b.db.Bucket(), "/")); err != nil {
+		return err
+	}
+
+	if err := binary.Write(bw, binary.BigEndian, uint64(len(rr))); err != nil {
+		return err
+	}
+
+	for i := range rr {
+		enc, err := b.codec.Marshal(rr[i])
+		if err != nil {
+			return err
+		}
+
+		if err := binary.Write(bw, binary.BigEndian, uint32(len(enc))); err != nil {
+			return err
+		}
+
+		if _, err := bw.Write(enc); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Import reads a stream written by Export and inserts its sessions into
+// the store according to mode. Records that are already expired by the
+// time they're read are skipped.
+func (b *BoltStore) Import(ctx context.Context, r io.Reader, mode ImportMode) error {
+	br := bufio.NewReader(r)
+
+	var version uint32
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return ErrCorruptExport
+	}
+
+	if version != exportSchemaVersion {
+		return ErrUnsupportedSchemaVersion
+	}
+
+	if _, err := readString(br); err != nil {
+		return err
+	}
+
+	var count uint64
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return ErrCorruptExport
+	}
+
+	if mode == ImportReset {
+		if err := b.db.Drop(&record{}); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+
+		if b.index != nil {
+			b.index = newIndex()
+		}
+	}
+
+	for i := uint64(0); i < count; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var length uint32
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil {
+			return ErrCorruptExport
+		}
+
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return ErrCorruptExport
+		}
+
+		var rec record
+		if err := b.codec.Unmarshal(buf, &rec); err != nil {
+			return err
+		}
+
+		if rec.ExpiresAt.Before(time.Now()) {
+			continue
+		}
+
+		if mode == ImportMerge {
+			var existing record
+			if err := b.detectErr(b.db.One("ID", rec.ID, &existing)); err != nil {
+				return err
+			}
+
+			if existing.ID == rec.ID {
+				continue
+			}
+		}
+
+		if err := b.detectErr(b.db.Save(&rec)); err != nil {
+			return err
+		}
+
+		if b.index != nil {
+			b.index.add(rec)
+		}
+	}
+
+	return nil
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(s))); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, s)
+
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", ErrCorruptExport
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", ErrCorruptExport
+	}
+
+	return string(buf), nil
+}
+
+// Copy copies every session from src into dst, using src's own record
+// bucket to discover the distinct user keys involved and
+// FetchByUserKey/Create to copy their sessions across; src is left as it
+// is. dst only needs to
+// satisfy sessionup.Store, so this migrates a BoltStore onto a Redis- or
+// SQL-backed implementation, for example. The direction is one-way: src
+// must be a *BoltStore because sessionup.Store has no way to enumerate the
+// sessions it holds, so migrating from an arbitrary Store into a BoltStore
+// isn't possible through this helper.
+func Copy(ctx context.Context, src *BoltStore, dst sessionup.Store) error {
+	var rr []record
+	if err := src.detectErr(src.db.All(&rr)); err != nil {
+		return err
+	}
+
+	seen := make(map[string]struct{}, len(rr))
+
+	for i := range rr {
+		userKey := rr[i].UserKey
+		if _, ok := seen[userKey]; ok {
+			continue
+		}
+
+		seen[userKey] = struct{}{}
+
+		sessions, err := src.FetchByUserKey(ctx, userKey)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range sessions {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			if err := dst.Create(ctx, s); err != nil && !errors.Is(err, sessionup.ErrDuplicateID) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func (s *Suite) Test_BoltStore_Export_Import_roundtrip() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "export.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	st, err := New(db, "b", 0)
+	s.Require().NoError(err)
+
+	sess1 := stubSession("A", "1", time.Now().Add(time.Hour))
+	sess1.Meta = map[string]string{"role": "admin"}
+	sess1.IP = net.ParseIP("127.0.0.1")
+	sess1.Agent.OS = "linux"
+	sess1.Agent.Browser = "firefox"
+
+	sess2 := stubSession("B", "2", time.Now().Add(time.Hour))
+
+	s.Require().NoError(st.Create(context.Background(), sess1))
+	s.Require().NoError(st.Create(context.Background(), sess2))
+
+	var buf bytes.Buffer
+	s.Require().NoError(st.Export(context.Background(), &buf))
+
+	dst, err := bolt.Open(filepath.Join(s.T().TempDir(), "import.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	dstSt, err := New(dst, "b", 0)
+	s.Require().NoError(err)
+
+	s.Require().NoError(dstSt.Import(context.Background(), bytes.NewReader(buf.Bytes()), ImportMerge))
+
+	got1, ok, err := dstSt.FetchByID(context.Background(), "1")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), sess1, got1)
+
+	got2, ok, err := dstSt.FetchByID(context.Background(), "2")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), sess2, got2)
+
+	s.Assert().Equal(IndexStats{Sessions: 2, UserKeys: 2}, dstSt.Stats())
+}
+
+func (s *Suite) Test_BoltStore_Import_modes() {
+	srcDB, err := bolt.Open(filepath.Join(s.T().TempDir(), "import-modes-src.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	srcSt, err := New(srcDB, "b", 0)
+	s.Require().NoError(err)
+
+	incoming := stubSession("B", "1", time.Now().Add(2*time.Hour))
+	s.Require().NoError(srcSt.Create(context.Background(), incoming))
+
+	var buf bytes.Buffer
+	s.Require().NoError(srcSt.Export(context.Background(), &buf))
+
+	dstDB, err := bolt.Open(filepath.Join(s.T().TempDir(), "import-modes-dst.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	st, err := New(dstDB, "b", 0)
+	s.Require().NoError(err)
+
+	original := stubSession("A", "1", time.Now().Add(time.Hour))
+	s.Require().NoError(st.Create(context.Background(), original))
+
+	// merge keeps the pre-existing record.
+	s.Require().NoError(st.Import(context.Background(), bytes.NewReader(buf.Bytes()), ImportMerge))
+
+	got, ok, err := st.FetchByID(context.Background(), "1")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), original, got)
+
+	// replace overwrites it.
+	s.Require().NoError(st.Import(context.Background(), bytes.NewReader(buf.Bytes()), ImportReplace))
+
+	got, ok, err = st.FetchByID(context.Background(), "1")
+	s.Require().NoError(err)
+	s.Require().True(ok)
+	equalSession(s.T(), incoming, got)
+
+	// reset drops everything that was there before importing, even records
+	// the incoming stream doesn't mention.
+	var emptyBuf bytes.Buffer
+	emptyDB, err := bolt.Open(filepath.Join(s.T().TempDir(), "import-modes-empty.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	emptySt, err := New(emptyDB, "b", 0)
+	s.Require().NoError(err)
+	s.Require().NoError(emptySt.Export(context.Background(), &emptyBuf))
+
+	s.Require().NoError(st.Import(context.Background(), bytes.NewReader(emptyBuf.Bytes()), ImportReset))
+
+	_, ok, err = st.FetchByID(context.Background(), "1")
+	s.Require().NoError(err)
+	s.Assert().False(ok)
+	s.Assert().Equal(IndexStats{}, st.Stats())
+}
+
+func (s *Suite) Test_BoltStore_Import_skipsExpired() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "import-expired.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	srcSt, err := New(db, "src", 0)
+	s.Require().NoError(err)
+
+	r := newRecord(stubSession("A", "1", time.Now().Add(-time.Hour)))
+	s.Require().NoError(srcSt.db.Save(&r))
+
+	var buf bytes.Buffer
+	s.Require().NoError(srcSt.Export(context.Background(), &buf))
+
+	dstSt, err := New(db, "dst", 0)
+	s.Require().NoError(err)
+
+	s.Require().NoError(dstSt.Import(context.Background(), bytes.NewReader(buf.Bytes()), ImportMerge))
+
+	s.Assert().Equal(IndexStats{}, dstSt.Stats())
+}
+
+func Test_Import_rejectsUnsupportedVersion(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "version.db"), 0600, nil)
+	require.NoError(t, err)
+
+	st, err := New(db, "b", 0)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, st.Export(context.Background(), &buf))
+
+	corrupt := buf.Bytes()
+	corrupt[3]++ // mangle the low byte of the schema version
+
+	err = st.Import(context.Background(), bytes.NewReader(corrupt), ImportMerge)
+	assert.Equal(t, ErrUnsupportedSchemaVersion, err)
+}
+
+func Test_Import_rejectsPartialStream(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "partial.db"), 0600, nil)
+	require.NoError(t, err)
+
+	st, err := New(db, "b", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, st.Create(context.Background(), stubSession("A", "1", time.Now().Add(time.Hour))))
+
+	var buf bytes.Buffer
+	require.NoError(t, st.Export(context.Background(), &buf))
+
+	truncated := buf.Bytes()[:buf.Len()-2]
+
+	db2, err := bolt.Open(filepath.Join(t.TempDir(), "partial2.db"), 0600, nil)
+	require.NoError(t, err)
+
+	st2, err := New(db2, "b", 0)
+	require.NoError(t, err)
+
+	err = st2.Import(context.Background(), bytes.NewReader(truncated), ImportMerge)
+	assert.Equal(t, ErrCorruptExport, err)
+}
+
+func Test_Copy(t *testing.T) {
+	srcDB, err := bolt.Open(filepath.Join(t.TempDir(), "copy-src.db"), 0600, nil)
+	require.NoError(t, err)
+
+	src, err := New(srcDB, "b", 0)
+	require.NoError(t, err)
+
+	sess1 := stubSession("A", "1", time.Now().Add(time.Hour))
+	sess2 := stubSession("A", "2", time.Now().Add(time.Hour))
+	sess3 := stubSession("B", "3", time.Now().Add(time.Hour))
+
+	require.NoError(t, src.Create(context.Background(), sess1))
+	require.NoError(t, src.Create(context.Background(), sess2))
+	require.NoError(t, src.Create(context.Background(), sess3))
+
+	dstDB, err := bolt.Open(filepath.Join(t.TempDir(), "copy-dst.db"), 0600, nil)
+	require.NoError(t, err)
+
+	dst, err := New(dstDB, "b", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, Copy(context.Background(), src, dst))
+
+	ss, err := dst.FetchByUserKey(context.Background(), "A")
+	require.NoError(t, err)
+	assert.Len(t, ss, 2)
+
+	ss, err = dst.FetchByUserKey(context.Background(), "B")
+	require.NoError(t, err)
+	assert.Len(t, ss, 1)
+}
@@ -0,0 +1,205 @@
+package boltstore
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// IndexStats reports the size of the in-memory secondary index maintained
+// by BoltStore, returned by Stats.
+type IndexStats struct {
+	// Sessions is the number of sessions currently tracked by the index.
+	Sessions int
+
+	// UserKeys is the number of distinct user keys currently tracked.
+	UserKeys int
+}
+
+// expiryEntry tracks a session's place in the expiry heap alongside the
+// user key it belongs to, so it can be located and removed from both index
+// structures by ID alone.
+type expiryEntry struct {
+	id        string
+	userKey   string
+	expiresAt time.Time
+	pos       int
+}
+
+// expiryHeap is a container/heap.Interface ordering sessions by ExpiresAt,
+// letting cleanup find the next-to-expire sessions in O(log n) instead of
+// scanning the whole bucket.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*expiryEntry)
+	e.pos = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.pos = -1
+	*h = old[:n-1]
+
+	return e
+}
+
+// index is an in-memory secondary index mirroring the record bucket. It
+// gives FetchByUserKey/DeleteByUserKey O(1) access to the IDs of a user's
+// sessions, and gives cleanup O(k) access to expired sessions via a
+// min-heap on ExpiresAt, instead of both having to scan the whole bucket.
+//
+// A nil *index is treated by BoltStore as "not maintained" and every
+// caller falls back to scanning the bucket directly through storm, which
+// is what happens for a BoltStore built without New.
+type index struct {
+	mu     sync.RWMutex
+	byUser map[string]map[string]struct{}
+	byID   map[string]*expiryEntry
+	expiry expiryHeap
+}
+
+func newIndex() *index {
+	return &index{
+		byUser: make(map[string]map[string]struct{}),
+		byID:   make(map[string]*expiryEntry),
+	}
+}
+
+// add inserts or, if id is already tracked, replaces the indexed entry for
+// r.
+func (x *index) add(r record) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.removeByIDLocked(r.ID)
+
+	ids, ok := x.byUser[r.UserKey]
+	if !ok {
+		ids = make(map[string]struct{})
+		x.byUser[r.UserKey] = ids
+	}
+	ids[r.ID] = struct{}{}
+
+	e := &expiryEntry{id: r.ID, userKey: r.UserKey, expiresAt: r.ExpiresAt}
+	x.byID[r.ID] = e
+	heap.Push(&x.expiry, e)
+}
+
+// removeByID removes id, and whichever user key it is tracked under, from
+// the index. It is a no-op if id isn't tracked.
+func (x *index) removeByID(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.removeByIDLocked(id)
+}
+
+func (x *index) removeByIDLocked(id string) {
+	e, ok := x.byID[id]
+	if !ok {
+		return
+	}
+
+	delete(x.byID, id)
+	heap.Remove(&x.expiry, e.pos)
+
+	if ids, ok := x.byUser[e.userKey]; ok {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(x.byUser, e.userKey)
+		}
+	}
+}
+
+// removeByUserKey removes every session tracked under userKey from the
+// index, except those whose IDs are in exceptIDs.
+func (x *index) removeByUserKey(userKey string, exceptIDs ...string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	except := make(map[string]struct{}, len(exceptIDs))
+	for _, id := range exceptIDs {
+		except[id] = struct{}{}
+	}
+
+	for id := range x.byUser[userKey] {
+		if _, ok := except[id]; ok {
+			continue
+		}
+
+		x.removeByIDLocked(id)
+	}
+}
+
+// userKeyIDs returns the IDs of every session currently tracked under
+// userKey, in no particular order.
+func (x *index) userKeyIDs(userKey string) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	ids := x.byUser[userKey]
+	if len(ids) == 0 {
+		return nil
+	}
+
+	out := make([]string, 0, len(ids))
+	for id := range ids {
+		out = append(out, id)
+	}
+
+	return out
+}
+
+// popExpired removes and returns, in ascending expiry order, up to limit
+// session IDs whose ExpiresAt is at or before before.
+func (x *index) popExpired(before time.Time, limit int) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var ids []string
+	for len(x.expiry) > 0 && len(ids) < limit {
+		if x.expiry[0].expiresAt.After(before) {
+			break
+		}
+
+		e := heap.Pop(&x.expiry).(*expiryEntry)
+		delete(x.byID, e.id)
+
+		if users, ok := x.byUser[e.userKey]; ok {
+			delete(users, e.id)
+			if len(users) == 0 {
+				delete(x.byUser, e.userKey)
+			}
+		}
+
+		ids = append(ids, e.id)
+	}
+
+	return ids
+}
+
+// stats returns the current size of the index.
+func (x *index) stats() IndexStats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return IndexStats{
+		Sessions: len(x.byID),
+		UserKeys: len(x.byUser),
+	}
+}
@@ -0,0 +1,122 @@
+package boltstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func Test_index_add_and_userKeyIDs(t *testing.T) {
+	x := newIndex()
+
+	x.add(stubRecord("A", "1", time.Now()))
+	x.add(stubRecord("A", "2", time.Now()))
+	x.add(stubRecord("B", "3", time.Now()))
+
+	assert.ElementsMatch(t, []string{"1", "2"}, x.userKeyIDs("A"))
+	assert.ElementsMatch(t, []string{"3"}, x.userKeyIDs("B"))
+	assert.Nil(t, x.userKeyIDs("C"))
+	assert.Equal(t, IndexStats{Sessions: 3, UserKeys: 2}, x.stats())
+}
+
+func Test_index_add_replaces_existing_entry(t *testing.T) {
+	x := newIndex()
+
+	x.add(stubRecord("A", "1", time.Now()))
+	x.add(stubRecord("B", "1", time.Now()))
+
+	assert.Nil(t, x.userKeyIDs("A"))
+	assert.ElementsMatch(t, []string{"1"}, x.userKeyIDs("B"))
+	assert.Equal(t, IndexStats{Sessions: 1, UserKeys: 1}, x.stats())
+}
+
+func Test_index_removeByID(t *testing.T) {
+	x := newIndex()
+
+	x.add(stubRecord("A", "1", time.Now()))
+	x.add(stubRecord("A", "2", time.Now()))
+
+	x.removeByID("1")
+	assert.ElementsMatch(t, []string{"2"}, x.userKeyIDs("A"))
+
+	// no-op for an ID that isn't tracked.
+	x.removeByID("does-not-exist")
+	assert.Equal(t, IndexStats{Sessions: 1, UserKeys: 1}, x.stats())
+
+	x.removeByID("2")
+	assert.Nil(t, x.userKeyIDs("A"))
+	assert.Equal(t, IndexStats{}, x.stats())
+}
+
+func Test_index_removeByUserKey(t *testing.T) {
+	x := newIndex()
+
+	x.add(stubRecord("A", "1", time.Now()))
+	x.add(stubRecord("A", "2", time.Now()))
+	x.add(stubRecord("A", "3", time.Now()))
+
+	x.removeByUserKey("A", "2")
+
+	assert.ElementsMatch(t, []string{"2"}, x.userKeyIDs("A"))
+	assert.Equal(t, IndexStats{Sessions: 1, UserKeys: 1}, x.stats())
+}
+
+func Test_index_popExpired(t *testing.T) {
+	x := newIndex()
+
+	now := time.Now()
+	x.add(stubRecord("A", "1", now.Add(-time.Minute)))
+	x.add(stubRecord("A", "2", now.Add(time.Hour)))
+	x.add(stubRecord("A", "3", now.Add(-time.Second)))
+
+	ids := x.popExpired(now, 10)
+	assert.Equal(t, []string{"1", "3"}, ids)
+	assert.ElementsMatch(t, []string{"2"}, x.userKeyIDs("A"))
+
+	// limit caps how many are popped per call.
+	x.add(stubRecord("B", "4", now.Add(-time.Minute)))
+	x.add(stubRecord("B", "5", now.Add(-time.Minute)))
+
+	first := x.popExpired(now, 1)
+	assert.Len(t, first, 1)
+
+	second := x.popExpired(now, 10)
+	assert.Len(t, second, 1)
+}
+
+func (s *Suite) Test_BoltStore_index_consistency_after_reopen() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "reopen.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	st, err := New(db, "b", 0)
+	s.Require().NoError(err)
+
+	s.Require().NoError(st.Create(context.Background(), stubSession("A", "1", time.Now().Add(time.Hour))))
+	s.Require().NoError(st.Create(context.Background(), stubSession("A", "2", time.Now().Add(time.Hour))))
+	s.Require().NoError(st.Create(context.Background(), stubSession("B", "3", time.Now().Add(-time.Hour))))
+
+	s.Assert().Equal(IndexStats{Sessions: 3, UserKeys: 2}, st.Stats())
+
+	// reopening against the same underlying db, without going through
+	// Close, simulates recovering after a crash: the index must be rebuilt
+	// from the bucket rather than trusting any in-memory state.
+	reopened, err := New(db, "b", 0)
+	s.Require().NoError(err)
+
+	s.Assert().Equal(IndexStats{Sessions: 3, UserKeys: 2}, reopened.Stats())
+
+	ss, err := reopened.FetchByUserKey(context.Background(), "A")
+	s.Require().NoError(err)
+	s.Assert().Len(ss, 2)
+
+	s.Require().NoError(reopened.cleanup())
+	s.Assert().Equal(IndexStats{Sessions: 2, UserKeys: 1}, reopened.Stats())
+
+	_, ok, err := reopened.FetchByID(context.Background(), "3")
+	s.Require().NoError(err)
+	s.Assert().False(ok)
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"errors"
 	"net"
+	"runtime"
 	"time"
 
 	"github.com/asdine/storm/v3/q"
 
 	"github.com/asdine/storm/v3"
-	"github.com/swithek/sessionup"
+	"github.com/jellydator/sessionup"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -19,13 +20,106 @@ var (
 
 	// ErrInvalidInterval is returned when invalid cleanup interval is provided.
 	ErrInvalidInterval = errors.New("invalid cleanup interval")
+
+	// ErrCiphertextTooShort is returned when an encrypted record is too
+	// short to contain a key ID and nonce, e.g. due to storage corruption.
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+
+	// ErrUnknownEncryptionKey is returned when an encrypted record
+	// references a key ID that isn't part of the configured key ring.
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+
+	// ErrEncryptionNotConfigured is returned by Rotate when the store
+	// wasn't created with WithEncryption.
+	ErrEncryptionNotConfigured = errors.New("encryption not configured")
+
+	// ErrNoEncryptionKeys is returned by WithEncryption when called
+	// without any keys.
+	ErrNoEncryptionKeys = errors.New("no encryption keys provided")
+
+	// ErrTooManyEncryptionKeys is returned by WithEncryption when given
+	// more keys than a 1-byte key ID can address.
+	ErrTooManyEncryptionKeys = errors.New("too many encryption keys")
 )
 
+// defaultCleanupBatchSize is the number of expired records removed per
+// cleanup transaction when WithCleanupBatchSize isn't provided.
+const defaultCleanupBatchSize = 1000
+
+// CleanupStats carries the outcome of a single cleanup batch, emitted on
+// the channel returned by CleanupStats when WithCleanupStats is used.
+type CleanupStats struct {
+	// Deleted is the number of expired sessions removed in this batch.
+	Deleted int
+}
+
+// Option is used to customize BoltStore on creation.
+type Option func(*BoltStore) error
+
+// WithCleanupBatchSize overrides the default number of expired sessions
+// deleted per cleanup transaction. Values lower than one are ignored.
+func WithCleanupBatchSize(n int) Option {
+	return func(b *BoltStore) error {
+		if n > 0 {
+			b.cleanupBatchSize = n
+		}
+
+		return nil
+	}
+}
+
+// WithCleanupStats enables emission of per-batch cleanup statistics on the
+// channel returned by CleanupStats. Whenever the cleanup service is active,
+// stats from this channel will have to be drained, otherwise cleanup won't
+// be able to continue its process.
+func WithCleanupStats() Option {
+	return func(b *BoltStore) error {
+		b.statsCh = make(chan CleanupStats)
+		return nil
+	}
+}
+
+// WithCodec overrides the codec used to encode and decode session records.
+// GobCodec is used when this option isn't provided.
+func WithCodec(c Codec) Option {
+	return func(b *BoltStore) error {
+		if c != nil {
+			b.codec = c
+		}
+
+		return nil
+	}
+}
+
+// WithEncryption wraps the configured codec with AES-GCM encryption at
+// rest. keys[0] is the active key, used to encrypt new and rotated
+// records; any further keys are only used to decrypt records written
+// before a rotation. If WithCodec is also used, apply it before
+// WithEncryption so that encryption wraps the intended inner codec.
+func WithEncryption(keys ...[]byte) Option {
+	return func(b *BoltStore) error {
+		ec, err := newEncryptedCodec(b.codec, keys)
+		if err != nil {
+			return err
+		}
+
+		b.codec = ec
+
+		return nil
+	}
+}
+
 // BoltStore is a bolt implementation of sessionup.Store.
 type BoltStore struct {
-	db      storm.Node
-	errCh   chan error
-	closeCh chan struct{}
+	db               storm.Node
+	boltDB           *bolt.DB
+	errCh            chan error
+	statsCh          chan CleanupStats
+	closeCh          chan struct{}
+	cleanupInterval  time.Duration
+	cleanupBatchSize int
+	codec            Codec
+	index            *index
 }
 
 // New creates and returns a fresh intance of BoltStore.
@@ -34,7 +128,8 @@ type BoltStore struct {
 // Cleanup interval parameter is an interval time between each clean up. If
 // this interval is equal to zero, cleanup won't be executed. Cannot be less than
 // zero.
-func New(db *bolt.DB, bucket string, cleanupInterval time.Duration) (*BoltStore, error) {
+// Options can be used to customize cleanup behaviour, e.g. WithCleanupBatchSize.
+func New(db *bolt.DB, bucket string, cleanupInterval time.Duration, opts ...Option) (*BoltStore, error) {
 	if bucket == "" {
 		return nil, ErrInvalidBucket
 	}
@@ -43,15 +138,44 @@ func New(db *bolt.DB, bucket string, cleanupInterval time.Duration) (*BoltStore,
 		return nil, ErrInvalidInterval
 	}
 
-	sdb, err := storm.Open("", storm.UseDB(db))
+	b := &BoltStore{
+		boltDB:           db,
+		errCh:            make(chan error),
+		closeCh:          make(chan struct{}),
+		cleanupInterval:  cleanupInterval,
+		cleanupBatchSize: defaultCleanupBatchSize,
+		codec:            GobCodec{},
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+
+	sdb, err := storm.Open("", storm.UseDB(db), storm.Codec(stormCodec{codec: b.codec}))
 	if err != nil {
 		return nil, err
 	}
 
-	b := &BoltStore{
-		db:      sdb.From(bucket),
-		errCh:   make(chan error),
-		closeCh: make(chan struct{}),
+	b.db = sdb.From(bucket)
+
+	b.index = newIndex()
+	if err := b.detectErr(b.db.Select().Bucket(recordBucket).RawEach(func(_, v []byte) error {
+		var r record
+		if err := b.codec.Unmarshal(v, &r); err != nil {
+			// a record this store's codec/key ring can't decode (e.g. one
+			// written under a key not in this store's key ring) simply
+			// isn't indexed, so FetchByUserKey and cleanup, which go
+			// through the index, don't see it.
+			return nil
+		}
+
+		b.index.add(r)
+
+		return nil
+	})); err != nil {
+		return nil, err
 	}
 
 	if cleanupInterval != 0 {
@@ -90,7 +214,15 @@ func (b *BoltStore) Create(_ context.Context, s sessionup.Session) error {
 
 	r = newRecord(s)
 
-	return b.detectErr(b.db.Save(&r))
+	if err := b.detectErr(b.db.Save(&r)); err != nil {
+		return err
+	}
+
+	if b.index != nil {
+		b.index.add(r)
+	}
+
+	return nil
 }
 
 // FetchByID retrieves a session from the store by the provided ID.
@@ -108,14 +240,37 @@ func (b *BoltStore) FetchByID(_ context.Context, id string) (sessionup.Session,
 // FetchByUserKey retrieves all sessions associated with the
 // provided user key. If none are found, both return values will be nil.
 func (b *BoltStore) FetchByUserKey(_ context.Context, key string) ([]sessionup.Session, error) {
-	var rr []record
-	if err := b.db.Find("UserKey", key, &rr); err != nil {
-		return nil, b.detectErr(err)
+	if b.index == nil {
+		var rr []record
+		if err := b.db.Find("UserKey", key, &rr); err != nil {
+			return nil, b.detectErr(err)
+		}
+
+		ss := make([]sessionup.Session, len(rr))
+		for i := range rr {
+			ss[i] = rr[i].extractSession()
+		}
+
+		return ss, nil
 	}
 
-	ss := make([]sessionup.Session, len(rr))
-	for i := range rr {
-		ss[i] = rr[i].extractSession()
+	ids := b.index.userKeyIDs(key)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	ss := make([]sessionup.Session, 0, len(ids))
+	for _, id := range ids {
+		var r record
+		if err := b.db.One("ID", id, &r); err != nil {
+			if errors.Is(err, storm.ErrNotFound) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		ss = append(ss, r.extractSession())
 	}
 
 	return ss, nil
@@ -124,21 +279,47 @@ func (b *BoltStore) FetchByUserKey(_ context.Context, key string) ([]sessionup.S
 // DeleteByID deletes the session from the store by the provided ID.
 // If session is not found, this function will be no-op.
 func (b *BoltStore) DeleteByID(_ context.Context, id string) error {
-	return b.detectErr(b.db.Select(
+	if err := b.detectErr(b.db.Select(
 		q.Eq("ID", id),
-	).Delete(&record{}))
+	).Delete(&record{})); err != nil {
+		return err
+	}
+
+	if b.index != nil {
+		b.index.removeByID(id)
+	}
+
+	return nil
 }
 
 // DeleteByUserKey deletes all sessions associated with the provided user key,
 // except those whose IDs are provided as last argument.
 // If none are found, this function will no-op.
 func (b *BoltStore) DeleteByUserKey(_ context.Context, key string, expIDs ...string) error {
-	return b.detectErr(b.db.Select(
+	if err := b.detectErr(b.db.Select(
 		q.Eq("UserKey", key),
 		q.Not(
 			q.In("ID", expIDs),
 		),
-	).Delete(&record{}))
+	).Delete(&record{})); err != nil {
+		return err
+	}
+
+	if b.index != nil {
+		b.index.removeByUserKey(key, expIDs...)
+	}
+
+	return nil
+}
+
+// Stats returns the current size of the in-memory secondary index. It is
+// the zero value unless the store was created with New.
+func (b *BoltStore) Stats() IndexStats {
+	if b.index == nil {
+		return IndexStats{}
+	}
+
+	return b.index.stats()
 }
 
 // CleanupErr returns a channel that should be used to read and handle errors
@@ -149,6 +330,13 @@ func (b BoltStore) CleanupErr() <-chan error {
 	return b.errCh
 }
 
+// CleanupStats returns a channel that should be used to read per-batch
+// cleanup statistics. It is nil unless the store was created with
+// WithCleanupStats.
+func (b BoltStore) CleanupStats() <-chan CleanupStats {
+	return b.statsCh
+}
+
 // Close stops the cleanup service.
 // It always returns nil as an error, used to implement io.Closer interface.
 func (b *BoltStore) Close() error {
@@ -156,14 +344,76 @@ func (b *BoltStore) Close() error {
 	close(b.closeCh)
 	close(b.errCh)
 
+	if b.statsCh != nil {
+		close(b.statsCh)
+	}
+
 	return nil
 }
 
-// cleanup removes all expired records from the store by their expiration time.
+// cleanup removes expired records from the store by their expiration time,
+// in bounded batches of up to cleanupBatchSize records so that a single
+// long-running write transaction doesn't block concurrent calls.
+//
+// When the store maintains an in-memory index (i.e. it was built with
+// New), the IDs to delete are popped straight off its expiry heap, turning
+// each tick into O(k) work for k actually-expired sessions instead of a
+// full bucket scan.
 func (b *BoltStore) cleanup() error {
-	return b.detectErr(b.db.Select(
+	batchSize := b.cleanupBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultCleanupBatchSize
+	}
+
+	for {
+		ids, err := b.expiredIDs(batchSize)
+		if err != nil {
+			return b.detectErr(err)
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		if err := b.detectErr(b.db.Select(
+			q.In("ID", ids),
+		).Delete(&record{})); err != nil {
+			return err
+		}
+
+		if b.statsCh != nil {
+			b.statsCh <- CleanupStats{Deleted: len(ids)}
+		}
+
+		if len(ids) < batchSize {
+			return nil
+		}
+
+		runtime.Gosched()
+	}
+}
+
+// expiredIDs returns up to limit IDs of sessions that are expired as of
+// now, preferring the in-memory index when one is maintained and falling
+// back to a bucket scan otherwise.
+func (b *BoltStore) expiredIDs(limit int) ([]string, error) {
+	if b.index != nil {
+		return b.index.popExpired(time.Now(), limit), nil
+	}
+
+	var rr []record
+	if err := b.db.Select(
 		q.Lte("ExpiresAt", time.Now()),
-	).Delete(&record{}))
+	).Limit(limit).Find(&rr); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(rr))
+	for i := range rr {
+		ids[i] = rr[i].ID
+	}
+
+	return ids, nil
 }
 
 // detectError is a helper that transforms errors.
@@ -204,6 +454,11 @@ type record struct {
 		OS      string `json:"os"`
 		Browser string `json:"browser"`
 	} `json:"agent"`
+
+	// Meta specifies a map of metadata associated with the
+	// session. It is deliberately left untagged for storm so
+	// that it isn't indexed, keeping the bucket size down.
+	Meta map[string]string `json:"meta"`
 }
 
 // newRecord creates a fresh instance of new record.
@@ -214,6 +469,7 @@ func newRecord(s sessionup.Session) record {
 		ID:        s.ID,
 		UserKey:   s.UserKey,
 		IP:        s.IP,
+		Meta:      s.Meta,
 	}
 
 	r.Agent.OS = s.Agent.OS
@@ -230,6 +486,7 @@ func (r record) extractSession() sessionup.Session {
 		ID:        r.ID,
 		UserKey:   r.UserKey,
 		IP:        r.IP,
+		Meta:      r.Meta,
 	}
 
 	s.Agent.OS = r.Agent.OS
@@ -11,10 +11,10 @@ import (
 	"time"
 
 	"github.com/asdine/storm/v3"
+	"github.com/jellydator/sessionup"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
-	"github.com/swithek/sessionup"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -45,6 +45,19 @@ func Test_New(t *testing.T) {
 	assert.NotNil(t, s.errCh)
 	assert.NotNil(t, s.closeCh)
 	assert.Equal(t, "0s", s.cleanupInterval.String())
+	assert.Equal(t, defaultCleanupBatchSize, s.cleanupBatchSize)
+	assert.Nil(t, s.statsCh)
+
+	// WithCleanupBatchSize and WithCleanupStats options
+	s, err = New(db, "b-opts", 0, WithCleanupBatchSize(50), WithCleanupStats())
+	require.NoError(t, err)
+	assert.Equal(t, 50, s.cleanupBatchSize)
+	assert.NotNil(t, s.statsCh)
+
+	// invalid batch size is ignored in favour of the default
+	s, err = New(db, "b-opts2", 0, WithCleanupBatchSize(-1))
+	require.NoError(t, err)
+	assert.Equal(t, defaultCleanupBatchSize, s.cleanupBatchSize)
 
 	// auto cleanup doesn't delete old records
 	r1 := stubRecord("ABC", "1", time.Now())
@@ -69,8 +82,7 @@ func Test_New(t *testing.T) {
 	assert.Equal(t, time.Millisecond*5, s.cleanupInterval)
 
 	// auto cleanup deletes old records
-	r2 := stubRecord("ABC", "1", time.Now())
-	require.NoError(t, s.db.Save(&r2))
+	require.NoError(t, s.Create(context.Background(), stubSession("ABC", "1", time.Now())))
 
 	assert.Eventually(t, func() bool {
 		c, err = s.db.Count(&record{})
@@ -103,6 +115,10 @@ func Test_New(t *testing.T) {
 	assert.NotNil(t, s.closeCh)
 	assert.Equal(t, time.Millisecond*5, s.cleanupInterval)
 
+	// an expired record so the next tick has something to delete, and
+	// therefore a reason to touch the (soon to be closed) db.
+	require.NoError(t, s.Create(context.Background(), stubSession("ABC", "1", time.Now())))
+
 	ch := make(chan struct{})
 
 	go func() {
@@ -415,6 +431,46 @@ func (s *Suite) Test_BoltStore_cleanup() {
 	s.Assert().Error(err)
 }
 
+func (s *Suite) Test_BoltStore_cleanup_batches() {
+	db, err := bolt.Open(filepath.Join(s.T().TempDir(), "batches.db"), 0600, nil)
+	s.Require().NoError(err)
+
+	st, err := New(db, "b", 0, WithCleanupBatchSize(2), WithCleanupStats())
+	s.Require().NoError(err)
+
+	const total = 5
+	for i := 0; i < total; i++ {
+		sess := stubSession("A", strconv.Itoa(i), time.Now().Add(-time.Second))
+		s.Require().NoError(st.Create(context.Background(), sess))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- st.cleanup()
+	}()
+
+	var batches, deleted int
+	for deleted < total {
+		stat := <-st.CleanupStats()
+		batches++
+		deleted += stat.Deleted
+		s.Assert().True(stat.Deleted <= 2)
+
+		// the store must keep serving reads while cleanup works through
+		// its batches.
+		_, _, err := st.FetchByID(context.Background(), "does-not-exist")
+		s.Assert().NoError(err)
+	}
+
+	s.Require().NoError(<-done)
+	s.Assert().Equal(total, deleted)
+	s.Assert().True(batches >= 3)
+
+	c, err := st.db.Count(&record{})
+	s.Require().NoError(err)
+	s.Assert().Equal(0, c)
+}
+
 func Test_BoltStore_detectErr(t *testing.T) {
 	assert.NoError(t, BoltStore{}.detectErr(storm.ErrNotFound))
 	assert.NoError(t, BoltStore{}.detectErr(nil))